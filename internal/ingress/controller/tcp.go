@@ -17,63 +17,735 @@ limitations under the License.
 package controller
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog"
 
-	"github.com/paultag/sniff/parser"
 	"k8s.io/ingress-nginx/internal/ingress"
 )
 
+// defaultProxyProtocolReadTimeout bounds how long Handle waits for an
+// inbound PROXY protocol header before giving up, so a client that
+// trickles the header in one byte at a time cannot stall the listener.
+const defaultProxyProtocolReadTimeout = 5 * time.Second
+
+// defaultIdleTimeout bounds how long proxyConn waits for data on either
+// side of a passthrough connection before tearing it down.
+const defaultIdleTimeout = 10 * time.Minute
+
+// copyBufferSize is the size of the buffers proxyConn reuses from
+// bufferPool to copy data between the client and the backend.
+const copyBufferSize = 32 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+var (
+	sslPassthroughConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nginx_ingress_controller",
+			Subsystem: "ssl_passthrough",
+			Name:      "connections_total",
+			Help:      "Total number of SSL passthrough connections proxied, by SNI hostname and backend.",
+		},
+		[]string{"hostname", "backend"},
+	)
+
+	sslPassthroughBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "nginx_ingress_controller",
+			Subsystem: "ssl_passthrough",
+			Name:      "bytes_total",
+			Help:      "Total bytes proxied for SSL passthrough connections, by SNI hostname, backend and direction.",
+		},
+		[]string{"hostname", "backend", "direction"},
+	)
+
+	sslPassthroughDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "nginx_ingress_controller",
+			Subsystem: "ssl_passthrough",
+			Name:      "duration_seconds",
+			Help:      "Duration in seconds of SSL passthrough connections, by SNI hostname and backend.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20),
+		},
+		[]string{"hostname", "backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sslPassthroughConnections, sslPassthroughBytes, sslPassthroughDuration)
+}
+
+// proxyProtocolV2Signature is the fixed 12-byte prefix that identifies a
+// binary (v2) PROXY protocol header, as defined by the spec:
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const proxyProtocolV2Signature = "\x0D\x0A\x0D\x0A\x00\x0D\x0A\x51\x55\x49\x54\x0A"
+
+const (
+	proxyProtocolV2CmdProxy = 0x21 // version 2, PROXY command
+	proxyProtocolV2CmdLocal = 0x20 // version 2, LOCAL command
+
+	proxyProtocolV2AFInetStream  = 0x11 // AF_INET, SOCK_STREAM (TCP4)
+	proxyProtocolV2AFInet6Stream = 0x21 // AF_INET6, SOCK_STREAM (TCP6)
+	proxyProtocolV2AFUnspec      = 0x00 // AF_UNSPEC, used with the LOCAL command
+
+	// pp2TypeAuthority carries the hostname the connection was routed by:
+	// the TLS SNI hostname, or whatever hostname another sniffer produced.
+	pp2TypeAuthority = 0x02
+)
+
+// proxyProtocolV2TLV is a single Type-Length-Value entry appended to a
+// binary PROXY protocol v2 header.
+type proxyProtocolV2TLV struct {
+	Type  byte
+	Value []byte
+}
+
 // TCPServer describes a server that works in passthrough mode.
+//
+// Hostname is matched against the SNI hostname seen on the wire following
+// nginx's own server_name conventions: a literal value is an exact match, a
+// "*.foo.com" value matches any subdomain of foo.com, and a "~" prefix marks
+// the remainder as a regular expression.
 type TCPServer struct {
 	Hostname      string
 	IP            string
 	Port          int
 	ProxyProtocol bool
+	// ProxyProtocolVersion selects the PROXY protocol framing written to
+	// the backend: 1 for the human-readable v1 header (the default) or 2
+	// for the binary v2 header. Only used when ProxyProtocol is true.
+	ProxyProtocolVersion int
+	// ALPN optionally restricts this entry to connections that negotiated
+	// one of the listed ALPN protocols (e.g. "h2", "http/1.1"). An empty
+	// list accepts any ALPN, including none.
+	ALPN []string
+	// Protocols restricts this entry to connections a ConnectionSniffer
+	// identified as one of the listed protocols (e.g. "tls", "http/1.1",
+	// "http/2", "ssh"). An empty list accepts "tls" only, preserving the
+	// original SSL-passthrough-only behavior.
+	Protocols []string
+	// MaxConcurrentConnections caps the number of simultaneous connections
+	// piped to this backend. A connection that would exceed the cap is
+	// rejected immediately rather than queued. Zero means unlimited.
+	MaxConcurrentConnections int
+	// DialTimeout bounds how long Handle waits to establish a TCP
+	// connection to this backend. Zero uses defaultDialTimeout.
+	DialTimeout time.Duration
+	// FailureThreshold is the number of consecutive dial failures after
+	// which the circuit breaker opens and short-circuits new connections
+	// to this backend for CooldownPeriod. Zero disables the breaker.
+	FailureThreshold int
+	// CooldownPeriod is how long the circuit breaker stays open once
+	// FailureThreshold consecutive dial failures have been observed.
+	CooldownPeriod time.Duration
+
+	regexOnce sync.Once
+	regex     *regexp.Regexp
+	regexErr  error
+
+	semOnce       sync.Once
+	sem           chan struct{}
+	failures      int32
+	breakerOpenAt int64 // unix nanoseconds; 0 means closed
+	draining      int32
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+}
+
+// defaultDialTimeout bounds how long Handle waits to establish a TCP
+// connection to a backend when TCPServer.DialTimeout is unset.
+const defaultDialTimeout = 10 * time.Second
+
+func (s *TCPServer) dialTimeout() time.Duration {
+	if s.DialTimeout > 0 {
+		return s.DialTimeout
+	}
+	return defaultDialTimeout
+}
+
+func (s *TCPServer) semaphore() chan struct{} {
+	s.semOnce.Do(func() {
+		if s.MaxConcurrentConnections > 0 {
+			s.sem = make(chan struct{}, s.MaxConcurrentConnections)
+		}
+	})
+	return s.sem
+}
+
+// acquireSlot reserves a connection slot against MaxConcurrentConnections,
+// reporting false if the backend is already at capacity.
+func (s *TCPServer) acquireSlot() bool {
+	sem := s.semaphore()
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *TCPServer) releaseSlot() {
+	if sem := s.semaphore(); sem != nil {
+		<-sem
+	}
+}
+
+// breakerOpen reports whether the circuit breaker is currently short-
+// circuiting new connections to s, resetting it once CooldownPeriod has
+// elapsed.
+func (s *TCPServer) breakerOpen() bool {
+	if s.FailureThreshold <= 0 {
+		return false
+	}
+
+	openAt := atomic.LoadInt64(&s.breakerOpenAt)
+	if openAt == 0 {
+		return false
+	}
+	if time.Now().UnixNano() < openAt {
+		return true
+	}
+
+	atomic.StoreInt64(&s.breakerOpenAt, 0)
+	atomic.StoreInt32(&s.failures, 0)
+	return false
+}
+
+func (s *TCPServer) recordDialSuccess() {
+	atomic.StoreInt32(&s.failures, 0)
+}
+
+func (s *TCPServer) recordDialFailure() {
+	if s.FailureThreshold <= 0 {
+		return
+	}
+	if atomic.AddInt32(&s.failures, 1) >= int32(s.FailureThreshold) {
+		atomic.StoreInt64(&s.breakerOpenAt, time.Now().Add(s.CooldownPeriod).UnixNano())
+	}
+}
+
+func (s *TCPServer) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// trackConn registers conn as in-flight against s, so Drain can force-close
+// it if it's still open once the drain deadline passes.
+func (s *TCPServer) trackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *TCPServer) untrackConn(conn net.Conn) {
+	s.connsMu.Lock()
+	delete(s.conns, conn)
+	s.connsMu.Unlock()
+}
+
+func (s *TCPServer) activeConnCount() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return len(s.conns)
+}
+
+// closeActiveConns force-closes every connection still tracked against s.
+func (s *TCPServer) closeActiveConns() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// compiledRegexp lazily compiles and caches the regular expression for a
+// Hostname declared with the "~" prefix.
+func (s *TCPServer) compiledRegexp() (*regexp.Regexp, error) {
+	s.regexOnce.Do(func() {
+		s.regex, s.regexErr = regexp.Compile(strings.TrimPrefix(s.Hostname, "~"))
+	})
+	return s.regex, s.regexErr
+}
+
+// acceptsALPN reports whether s is eligible for a connection that
+// negotiated the given ALPN protocol.
+func (s *TCPServer) acceptsALPN(alpn string) bool {
+	if len(s.ALPN) == 0 {
+		return true
+	}
+	for _, p := range s.ALPN {
+		if p == alpn {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsProtocol reports whether s is eligible for a connection a
+// ConnectionSniffer identified as protocol.
+func (s *TCPServer) acceptsProtocol(protocol string) bool {
+	if len(s.Protocols) == 0 {
+		return protocol == "tls"
+	}
+	for _, p := range s.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectionSniffer inspects the bytes peeked from a freshly accepted
+// connection and, if it recognizes the protocol, extracts the hostname (or
+// equivalent routing key) used to pick a backend.
+type ConnectionSniffer interface {
+	// Sniff inspects peek, the bytes read so far from the connection, and
+	// reports the protocol name, the extracted hostname, and whether it was
+	// able to reach a decision.
+	Sniff(peek []byte) (protocol, hostname string, ok bool)
+}
+
+// defaultSniffers are the ConnectionSniffers Handle runs, in order, when
+// TCPProxy.Sniffers is nil.
+//
+// There is no sniffer for cleartext HTTP/2: the :authority pseudo-header
+// that would carry the hostname is HPACK-compressed, and real clients
+// reference it through the HPACK static table with a Huffman-coded value
+// rather than sending it as a literal string, which needs a real HPACK
+// decoder (static table, integer and Huffman decoding) to read. Until one
+// is implemented, cleartext HTTP/2 connections fall through to
+// TCPProxy.Default instead of being routed by hostname.
+var defaultSniffers = []ConnectionSniffer{
+	tlsSniffer{},
+	http1Sniffer{},
+	sshSniffer{},
+}
+
+// tlsSniffer recognizes a TLS ClientHello and extracts the SNI hostname.
+type tlsSniffer struct{}
+
+func (tlsSniffer) Sniff(peek []byte) (protocol, hostname string, ok bool) {
+	hostname, _, ok = parseClientHello(peek)
+	if !ok {
+		return "", "", false
+	}
+	return "tls", hostname, true
+}
+
+// http1RequestLineRE matches the request line of a plaintext HTTP/1.x
+// request, e.g. "GET / HTTP/1.1\r\n".
+var http1RequestLineRE = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/1\.[01]\r\n`)
+
+// http1Sniffer recognizes a plaintext HTTP/1.x request and extracts the
+// Host header.
+type http1Sniffer struct{}
+
+func (http1Sniffer) Sniff(peek []byte) (protocol, hostname string, ok bool) {
+	if !http1RequestLineRE.Match(peek) {
+		return "", "", false
+	}
+
+	headers := peek
+	if idx := bytes.Index(peek, []byte("\r\n\r\n")); idx >= 0 {
+		headers = peek[:idx]
+	}
+
+	for _, line := range bytes.Split(headers, []byte("\r\n")) {
+		if len(line) > 5 && bytes.EqualFold(line[:5], []byte("Host:")) {
+			return "http/1.1", stripHostPort(strings.TrimSpace(string(line[5:]))), true
+		}
+	}
+
+	return "", "", false
+}
+
+// stripHostPort removes a trailing ":port" from a Host header value, which
+// RFC 7230 section 5.4 requires clients to include whenever the port
+// differs from the scheme's default — the normal case for a passthrough
+// listener on a non-standard port. host is returned unchanged if it carries
+// no port (or is a bare IPv6 literal with no port, e.g. "[::1]").
+func stripHostPort(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return h
+}
+
+// sshBannerRE matches an SSH identification banner whose comment field
+// carries a "user@host" routing hint.
+var sshBannerRE = regexp.MustCompile(`^SSH-2\.0-\S+ \S+@(\S+)\r?\n`)
+
+// sshSniffer recognizes an SSH client identification banner. Upstream SSH
+// carries no hostname at connection time, so this only supports
+// deployments whose clients append a "user@host" hint to the banner's
+// comment field (RFC 4253 section 4.2), e.g.
+// "SSH-2.0-OpenSSH_8.9 deploy@prod-1".
+type sshSniffer struct{}
+
+func (sshSniffer) Sniff(peek []byte) (protocol, hostname string, ok bool) {
+	if !bytes.HasPrefix(peek, []byte("SSH-2.0-")) {
+		return "", "", false
+	}
+	if !bytes.Contains(peek, []byte("\n")) {
+		// Banner line hasn't fully arrived yet.
+		return "ssh", "", false
+	}
+
+	matches := sshBannerRE.FindSubmatch(peek)
+	if matches == nil {
+		return "ssh", "", false
+	}
+
+	return "ssh", string(matches[1]), true
 }
 
 // TCPProxy describes the passthrough servers and a default as catch all.
 type TCPProxy struct {
 	ServerList []*TCPServer
 	Default    *TCPServer
+
+	// AcceptProxyProtocol indicates that inbound connections on the
+	// passthrough listener are prefixed with a PROXY protocol (v1 or v2)
+	// header, as configured by the "use-proxy-protocol" ConfigMap key.
+	// When set, Handle decodes the header and uses the address it carries,
+	// instead of conn.RemoteAddr(), for whitelist checks.
+	AcceptProxyProtocol bool
+
+	// ProxyProtocolReadTimeout bounds how long Handle waits for the PROXY
+	// protocol header described above. Zero uses
+	// defaultProxyProtocolReadTimeout.
+	ProxyProtocolReadTimeout time.Duration
+
+	// Sniffers are the ConnectionSniffers Handle runs, in order, against
+	// the bytes peeked from a new connection to determine its protocol and
+	// hostname. Nil uses defaultSniffers.
+	Sniffers []ConnectionSniffer
+}
+
+func (p *TCPProxy) proxyProtocolReadTimeout() time.Duration {
+	if p.ProxyProtocolReadTimeout > 0 {
+		return p.ProxyProtocolReadTimeout
+	}
+	return defaultProxyProtocolReadTimeout
 }
 
-// Get returns the TCPServer to use for a given host.
-func (p *TCPProxy) Get(host string) *TCPServer {
+func (p *TCPProxy) sniffers() []ConnectionSniffer {
+	if p.Sniffers != nil {
+		return p.Sniffers
+	}
+	return defaultSniffers
+}
+
+// drainPollInterval is how often Drain checks whether server's in-flight
+// connections have finished.
+const drainPollInterval = 50 * time.Millisecond
+
+// Drain marks server as being removed from rotation, so Handle stops
+// dialing new connections to it, then waits for its existing piped
+// connections to finish. If ctx is done first, any connections still open
+// are force-closed. Callers (the controller's reload path) should call
+// Drain for each TCPServer that is being changed or removed before
+// discarding it.
+func (p *TCPProxy) Drain(ctx context.Context, server *TCPServer) {
+	atomic.StoreInt32(&server.draining, 1)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if server.activeConnCount() == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			klog.Warningf("Timed out draining backend %s:%d, closing %d remaining connection(s).", server.IP, server.Port, server.activeConnCount())
+			server.closeActiveConns()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Get returns the TCPServer to use for a given protocol, hostname and ALPN
+// protocol. Matching is deterministic, tried in this order: exact hostname,
+// longest matching suffix wildcard (e.g. "*.foo.com"), first matching
+// regular expression (a Hostname prefixed with "~"), and finally Default.
+func (p *TCPProxy) Get(protocol, hostname, alpn string) *TCPServer {
 	if p.ServerList == nil {
 		return p.Default
 	}
 
+	if s := p.matchExact(protocol, hostname, alpn); s != nil {
+		return s
+	}
+	if s := p.matchWildcard(protocol, hostname, alpn); s != nil {
+		return s
+	}
+	if s := p.matchRegex(protocol, hostname, alpn); s != nil {
+		return s
+	}
+
+	return p.Default
+}
+
+func (p *TCPProxy) matchExact(protocol, hostname, alpn string) *TCPServer {
 	for _, s := range p.ServerList {
-		if s.Hostname == host {
+		if s.Hostname == hostname && s.acceptsALPN(alpn) && s.acceptsProtocol(protocol) {
 			return s
 		}
 	}
+	return nil
+}
 
-	return p.Default
+func (p *TCPProxy) matchWildcard(protocol, hostname, alpn string) *TCPServer {
+	var best *TCPServer
+	bestLen := -1
+
+	for _, s := range p.ServerList {
+		if !strings.HasPrefix(s.Hostname, "*.") || !s.acceptsALPN(alpn) || !s.acceptsProtocol(protocol) {
+			continue
+		}
+
+		suffix := s.Hostname[1:] // ".foo.com"
+		if strings.HasSuffix(hostname, suffix) && hostname != suffix[1:] && len(suffix) > bestLen {
+			best = s
+			bestLen = len(suffix)
+		}
+	}
+
+	return best
 }
 
-// Handle reads enough information from the connection to extract the hostname
-// and open a connection to the passthrough server.
-func (p *TCPProxy) Handle(conn net.Conn, config *ingress.Configuration) {
+func (p *TCPProxy) matchRegex(protocol, hostname, alpn string) *TCPServer {
+	for _, s := range p.ServerList {
+		if !strings.HasPrefix(s.Hostname, "~") || !s.acceptsALPN(alpn) || !s.acceptsProtocol(protocol) {
+			continue
+		}
+
+		re, err := s.compiledRegexp()
+		if err != nil {
+			klog.Warningf("Invalid regex server name %q: %v", s.Hostname, err)
+			continue
+		}
+		if re.MatchString(hostname) {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// parseClientHello parses a TLS ClientHello record and returns the SNI
+// hostname and the ALPN protocols the client advertised, in the order they
+// appear in the ALPN extension. It implements just enough of
+// RFC 8446 section 4 to reach the server_name (0x00) and
+// application_layer_protocol_negotiation (0x10) extensions.
+func parseClientHello(data []byte) (hostname string, alpnProtocols []string, ok bool) {
+	if len(data) < 5 || data[0] != 0x16 {
+		return "", nil, false
+	}
+	recordLen := int(data[3])<<8 | int(data[4])
+	if len(data) < 5+recordLen {
+		return "", nil, false
+	}
+	hs := data[5 : 5+recordLen]
+
+	if len(hs) < 4 || hs[0] != 0x01 {
+		return "", nil, false
+	}
+	hsLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+hsLen {
+		return "", nil, false
+	}
+	body := hs[4 : 4+hsLen]
+
+	pos := 2 + 32 // client_version(2) + random(32)
+	if len(body) < pos+1 {
+		return "", nil, false
+	}
+
+	sessionIDLen := int(body[pos])
+	pos += 1 + sessionIDLen
+	if len(body) < pos+2 {
+		return "", nil, false
+	}
+
+	cipherSuitesLen := int(body[pos])<<8 | int(body[pos+1])
+	pos += 2 + cipherSuitesLen
+	if len(body) < pos+1 {
+		return "", nil, false
+	}
+
+	compressionMethodsLen := int(body[pos])
+	pos += 1 + compressionMethodsLen
+	if len(body) < pos+2 {
+		return "", nil, false
+	}
+
+	extensionsLen := int(body[pos])<<8 | int(body[pos+1])
+	pos += 2
+	if len(body) < pos+extensionsLen {
+		return "", nil, false
+	}
+	extensions := body[pos : pos+extensionsLen]
+
+	for len(extensions) >= 4 {
+		extType := int(extensions[0])<<8 | int(extensions[1])
+		extLen := int(extensions[2])<<8 | int(extensions[3])
+		if len(extensions) < 4+extLen {
+			break
+		}
+		extData := extensions[4 : 4+extLen]
+
+		switch extType {
+		case 0x00: // server_name
+			hostname = parseSNIExtension(extData)
+		case 0x10: // application_layer_protocol_negotiation
+			alpnProtocols = parseALPNExtension(extData)
+		}
+
+		extensions = extensions[4+extLen:]
+	}
+
+	return hostname, alpnProtocols, hostname != "" || len(alpnProtocols) > 0
+}
+
+func parseSNIExtension(extData []byte) string {
+	if len(extData) < 2 {
+		return ""
+	}
+	listLen := int(extData[0])<<8 | int(extData[1])
+	list := extData[2:]
+	if len(list) > listLen {
+		list = list[:listLen]
+	}
+
+	for len(list) >= 3 {
+		nameType := list[0]
+		nameLen := int(list[1])<<8 | int(list[2])
+		if len(list) < 3+nameLen {
+			break
+		}
+		if nameType == 0x00 { // host_name
+			return string(list[3 : 3+nameLen])
+		}
+		list = list[3+nameLen:]
+	}
+
+	return ""
+}
+
+func parseALPNExtension(extData []byte) []string {
+	if len(extData) < 2 {
+		return nil
+	}
+	listLen := int(extData[0])<<8 | int(extData[1])
+	list := extData[2:]
+	if len(list) > listLen {
+		list = list[:listLen]
+	}
+
+	var protocols []string
+	for len(list) >= 1 {
+		protoLen := int(list[0])
+		if len(list) < 1+protoLen {
+			break
+		}
+		protocols = append(protocols, string(list[1:1+protoLen]))
+		list = list[1+protoLen:]
+	}
+
+	return protocols
+}
+
+// Handle reads enough information from the connection to extract the
+// hostname and open a connection to the passthrough server. ctx governs the
+// lifetime of the piped connection; it is cancelled by the controller on
+// graceful shutdown so in-flight passthrough sessions are torn down rather
+// than leaked.
+func (p *TCPProxy) Handle(ctx context.Context, conn net.Conn, config *ingress.Configuration) {
 	defer conn.Close()
-	data := make([]byte, 4096)
 	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
 
-	length, err := conn.Read(data)
-	if err != nil {
-		klog.V(4).Infof("Error reading the first 4k of the connection: %v", err)
+	reader := bufio.NewReader(conn)
+	if p.AcceptProxyProtocol {
+		decoded, err := readProxyProtocolHeader(conn, reader, p.proxyProtocolReadTimeout())
+		if err != nil {
+			klog.V(4).Infof("Error reading PROXY protocol header: %v", err)
+			return
+		}
+		if decoded != nil {
+			remoteAddr = decoded
+		}
+	}
+	// Any connections that came in through the bufio.Reader still hold
+	// buffered bytes the raw conn hasn't seen; route the rest of the
+	// connection's reads through it too, so nothing is lost once proxyConn
+	// takes over.
+	conn = &bufConn{Conn: conn, reader: reader}
+
+	// Wait for at least one byte, then grab whatever a single underlying
+	// Read made available without blocking for the sniffers' full peek
+	// size, which a short request (e.g. a small HTTP GET) may never fill.
+	if _, err := reader.Peek(1); err != nil {
+		klog.V(4).Infof("Error reading the first bytes of the connection: %v", err)
 		return
 	}
+	peeked, _ := reader.Peek(reader.Buffered())
+
+	var protocol, hostname string
+	for _, sniffer := range p.sniffers() {
+		if proto, host, ok := sniffer.Sniff(peeked); ok {
+			protocol, hostname = proto, host
+			break
+		}
+	}
+
+	alpn := ""
+	if protocol == "tls" {
+		if _, alpnProtocols, ok := parseClientHello(peeked); ok && len(alpnProtocols) > 0 {
+			alpn = alpnProtocols[0]
+		}
+	}
 
 	proxy := p.Default
-	hostname, err := parser.GetHostname(data[:])
-	if err == nil {
-		klog.V(4).Infof("Parsed hostname from TLS Client Hello: %s", hostname)
-		proxy = p.Get(hostname)
+	if hostname != "" {
+		klog.V(4).Infof("Parsed hostname from %s connection: %s, ALPN: %s", protocol, hostname, alpn)
+		proxy = p.Get(protocol, hostname, alpn)
+	}
+
+	data := make([]byte, len(peeked))
+	length, err := reader.Read(data)
+	if err != nil {
+		klog.V(4).Infof("Error reading the first bytes of the connection: %v", err)
+		return
 	}
 
 	if proxy == nil {
@@ -81,7 +753,23 @@ func (p *TCPProxy) Handle(conn net.Conn, config *ingress.Configuration) {
 		return
 	}
 
+	// Track this connection against proxy as soon as it has committed to
+	// that backend, not once net.DialTimeout below succeeds. Dialing can
+	// take up to DialTimeout (default 10s); tracking it only afterward left
+	// a window where Drain's poll loop could observe activeConnCount() == 0
+	// and consider the backend fully drained while a brand-new connection
+	// to it was still being established.
+	proxy.trackConn(conn)
+	defer proxy.untrackConn(conn)
+
 	for _, server := range config.Servers {
+		// The CIDR whitelist below is configured per SNI hostname and only
+		// makes sense for TLS passthrough; skip it for hostnames a different
+		// sniffer (HTTP/1.1 Host, SSH user@host) produced,
+		// which could otherwise collide with an unrelated whitelisted server.
+		if protocol != "tls" {
+			break
+		}
 		if server.Hostname != hostname {
 			continue
 		}
@@ -111,25 +799,52 @@ func (p *TCPProxy) Handle(conn net.Conn, config *ingress.Configuration) {
 		break
 	}
 
-	clientConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", proxy.IP, proxy.Port))
+	if proxy.isDraining() {
+		klog.V(4).Infof("Backend %s:%d is draining, rejecting new connection.", proxy.IP, proxy.Port)
+		return
+	}
+
+	if proxy.breakerOpen() {
+		klog.V(4).Infof("Circuit breaker open for backend %s:%d, rejecting new connection.", proxy.IP, proxy.Port)
+		return
+	}
+
+	if !proxy.acquireSlot() {
+		klog.V(4).Infof("Backend %s:%d is at MaxConcurrentConnections, rejecting new connection.", proxy.IP, proxy.Port)
+		return
+	}
+	defer proxy.releaseSlot()
+
+	clientConn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", proxy.IP, proxy.Port), proxy.dialTimeout())
 	if err != nil {
+		proxy.recordDialFailure()
 		return
 	}
+	proxy.recordDialSuccess()
 	defer clientConn.Close()
 
 	if proxy.ProxyProtocol {
-		// write out the Proxy Protocol header
 		localAddr := conn.LocalAddr().(*net.TCPAddr)
 
-		protocol := "UNKNOWN"
-		if remoteAddr.IP.To4() != nil {
-			protocol = "TCP4"
-		} else if remoteAddr.IP.To16() != nil {
-			protocol = "TCP6"
+		if proxy.ProxyProtocolVersion == 2 {
+			klog.V(4).Infof("Writing PROXY protocol v2 header, hostname: %s", hostname)
+			tlvs := []proxyProtocolV2TLV{}
+			if hostname != "" {
+				tlvs = append(tlvs, proxyProtocolV2TLV{Type: pp2TypeAuthority, Value: []byte(hostname)})
+			}
+			err = writeProxyProtocolV2(clientConn, remoteAddr, localAddr, tlvs)
+		} else {
+			// write out the v1, human-readable Proxy Protocol header
+			protocol := "UNKNOWN"
+			if remoteAddr.IP.To4() != nil {
+				protocol = "TCP4"
+			} else if remoteAddr.IP.To16() != nil {
+				protocol = "TCP6"
+			}
+			proxyProtocolHeader := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", protocol, remoteAddr.IP.String(), localAddr.IP.String(), remoteAddr.Port, localAddr.Port)
+			klog.V(4).Infof("Writing Proxy Protocol header: %s", proxyProtocolHeader)
+			_, err = fmt.Fprintf(clientConn, proxyProtocolHeader)
 		}
-		proxyProtocolHeader := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", protocol, remoteAddr.IP.String(), localAddr.IP.String(), remoteAddr.Port, localAddr.Port)
-		klog.V(4).Infof("Writing Proxy Protocol header: %s", proxyProtocolHeader)
-		_, err = fmt.Fprintf(clientConn, proxyProtocolHeader)
 	}
 	if err != nil {
 		klog.Errorf("Error writing Proxy Protocol header: %v", err)
@@ -142,22 +857,292 @@ func (p *TCPProxy) Handle(conn net.Conn, config *ingress.Configuration) {
 		}
 	}
 
-	pipe(clientConn, conn)
+	proxyConn(ctx, clientConn, conn, proxyConnOptions{
+		Hostname: hostname,
+		Backend:  fmt.Sprintf("%s:%d", proxy.IP, proxy.Port),
+	})
 }
 
-func pipe(client, server net.Conn) {
-	doCopy := func(s, c net.Conn, cancel chan<- bool) {
-		io.Copy(s, c)
-		cancel <- true
+// writeProxyProtocolV2 writes a binary (v2) PROXY protocol header to conn,
+// addressed from src to dst and carrying tlvs. When src is not a
+// *net.TCPAddr (e.g. the connection arrived over a UNIX socket) there is no
+// client address to forward, so the header falls back to the LOCAL command
+// with an unspecified address family.
+func writeProxyProtocolV2(conn net.Conn, src, dst net.Addr, tlvs []proxyProtocolV2TLV) error {
+	var header bytes.Buffer
+	header.WriteString(proxyProtocolV2Signature)
+
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+
+	cmd := byte(proxyProtocolV2CmdLocal)
+	family := byte(proxyProtocolV2AFUnspec)
+	var addrBlock []byte
+
+	if srcOK && dstOK {
+		if ip4 := srcTCP.IP.To4(); ip4 != nil && dstTCP.IP.To4() != nil {
+			cmd = proxyProtocolV2CmdProxy
+			family = proxyProtocolV2AFInetStream
+			addrBlock = make([]byte, 12)
+			copy(addrBlock[0:4], ip4)
+			copy(addrBlock[4:8], dstTCP.IP.To4())
+			binary.BigEndian.PutUint16(addrBlock[8:10], uint16(srcTCP.Port))
+			binary.BigEndian.PutUint16(addrBlock[10:12], uint16(dstTCP.Port))
+		} else if ip6 := srcTCP.IP.To16(); ip6 != nil {
+			cmd = proxyProtocolV2CmdProxy
+			family = proxyProtocolV2AFInet6Stream
+			addrBlock = make([]byte, 36)
+			copy(addrBlock[0:16], ip6)
+			copy(addrBlock[16:32], dstTCP.IP.To16())
+			binary.BigEndian.PutUint16(addrBlock[32:34], uint16(srcTCP.Port))
+			binary.BigEndian.PutUint16(addrBlock[34:36], uint16(dstTCP.Port))
+		}
 	}
 
-	cancel := make(chan bool, 2)
+	header.WriteByte(cmd)
+	header.WriteByte(family)
 
-	go doCopy(server, client, cancel)
-	go doCopy(client, server, cancel)
+	var tlvBytes bytes.Buffer
+	for _, tlv := range tlvs {
+		tlvBytes.WriteByte(tlv.Type)
+		tlvLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(tlvLen, uint16(len(tlv.Value)))
+		tlvBytes.Write(tlvLen)
+		tlvBytes.Write(tlv.Value)
+	}
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrBlock)+tlvBytes.Len()))
+	header.Write(length)
+	header.Write(addrBlock)
+	header.Write(tlvBytes.Bytes())
+
+	_, err := conn.Write(header.Bytes())
+	return err
+}
+
+// proxyProtocolV1Prefix is the fixed prefix of a human-readable (v1) PROXY
+// protocol header.
+const proxyProtocolV1Prefix = "PROXY "
+
+// bufConn wraps a net.Conn to read through reader instead of calling
+// conn.Read directly, so that bytes buffered while detecting a PROXY
+// protocol header aren't lost once the caller switches back to reading the
+// connection normally.
+type bufConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite forwards to the embedded conn's CloseWrite when it implements
+// one (as *net.TCPConn does). Embedding net.Conn alone doesn't promote this
+// method, since the embedded field's static type is the interface, not the
+// concrete connection; without this override closeWrite's type assertion on
+// a *bufConn always fails and silently falls back to a full Close.
+func (c *bufConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// CloseRead forwards to the embedded conn's CloseRead when it implements
+// one, for the same reason as CloseWrite above.
+func (c *bufConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyProtocolHeader detects and consumes a PROXY protocol v1 or v2
+// header from reader, returning the client address it carries. A nil
+// address with a nil error means either no PROXY header was present or the
+// header carried no client address (v1 UNKNOWN, v2 LOCAL, or a v2 address
+// family other than TCP4/TCP6).
+func readProxyProtocolHeader(conn net.Conn, reader *bufio.Reader, timeout time.Duration) (*net.TCPAddr, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	if signature, err := reader.Peek(len(proxyProtocolV2Signature)); err == nil && string(signature) == proxyProtocolV2Signature {
+		return readProxyProtocolV2(reader)
+	}
+
+	if prefix, err := reader.Peek(len(proxyProtocolV1Prefix)); err == nil && string(prefix) == proxyProtocolV1Prefix {
+		return readProxyProtocolV1(reader)
+	}
+
+	return nil, nil
+}
+
+// readProxyProtocolV1 parses a "PROXY TCP4|TCP6 src dst sport dport\r\n"
+// header, consuming it from reader.
+func readProxyProtocolV1(reader *bufio.Reader) (*net.TCPAddr, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source address: %q", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source port: %v", err)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtocolV2 parses a binary PROXY protocol v2 header, consuming it
+// from reader. A LOCAL command (used by health checks) carries no address
+// and returns a nil address with a nil error.
+func readProxyProtocolV2(reader *bufio.Reader) (*net.TCPAddr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	verCmd := header[len(proxyProtocolV2Signature)]
+	family := header[len(proxyProtocolV2Signature)+1]
+	length := int(header[len(proxyProtocolV2Signature)+2])<<8 | int(header[len(proxyProtocolV2Signature)+3])
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	if verCmd&0xF0 != 0x20 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version byte: %#x", verCmd)
+	}
+	if verCmd&0x0F == proxyProtocolV2CmdLocal&0x0F {
+		return nil, nil
+	}
+
+	switch family {
+	case proxyProtocolV2AFInetStream:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY protocol v2 TCP4 address block")
+		}
+		port := int(body[8])<<8 | int(body[9])
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: port}, nil
+	case proxyProtocolV2AFInet6Stream:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY protocol v2 TCP6 address block")
+		}
+		port := int(body[32])<<8 | int(body[33])
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: port}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// proxyConnOptions bundles the labels and tunables proxyConn needs beyond
+// the two connections it pipes together.
+type proxyConnOptions struct {
+	IdleTimeout time.Duration
+	Hostname    string
+	Backend     string
+}
+
+// proxyConn pipes data between client and server in both directions until
+// ctx is done or both copies finish on their own, enforcing an idle read
+// timeout and recording passthrough metrics.
+func proxyConn(ctx context.Context, client, server net.Conn, opts proxyConnOptions) {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyHalf(&wg, server, client, opts, "upstream")
+	go copyHalf(&wg, client, server, opts, "downstream")
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 
 	select {
-	case <-cancel:
+	case <-done:
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		<-done
+	}
+
+	sslPassthroughConnections.WithLabelValues(opts.Hostname, opts.Backend).Inc()
+	sslPassthroughDuration.WithLabelValues(opts.Hostname, opts.Backend).Observe(time.Since(start).Seconds())
+}
+
+// copyHalf copies from src to dst, applying opts.IdleTimeout on every read
+// from src. Once src is drained or errors out it half-closes dst for
+// writing and src for reading so the peer copyHalf goroutine unblocks
+// promptly instead of waiting for the OS to notice the connection is dead.
+func copyHalf(wg *sync.WaitGroup, dst, src net.Conn, opts proxyConnOptions, direction string) {
+	defer wg.Done()
+
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+	buf := *bufPtr
+
+	for {
+		if err := src.SetReadDeadline(time.Now().Add(opts.IdleTimeout)); err != nil {
+			break
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			sslPassthroughBytes.WithLabelValues(opts.Hostname, opts.Backend, direction).Add(float64(n))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	closeWrite(dst)
+	closeRead(src)
+}
+
+// closeWrite half-closes conn for writing if it supports CloseWrite (as
+// *net.TCPConn does), otherwise it closes conn outright.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// closeRead half-closes conn for reading if it supports CloseRead (as
+// *net.TCPConn does), otherwise it closes conn outright.
+func closeRead(conn net.Conn) {
+	if cr, ok := conn.(interface{ CloseRead() error }); ok {
+		cr.CloseRead()
 		return
 	}
+	conn.Close()
 }
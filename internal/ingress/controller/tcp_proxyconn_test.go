@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProxyConnSurvivesClientHalfClose reproduces a normal request/response
+// passthrough connection: the client writes its request and half-closes its
+// write side (as, e.g., an HTTP client does after sending a request with no
+// further body) while the backend is still streaming its response. proxyConn
+// must keep piping the response to completion instead of tearing down the
+// whole connection the moment the client->backend direction finishes.
+func TestProxyConnSurvivesClientHalfClose(t *testing.T) {
+	clientListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer clientListener.Close()
+
+	backendListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backendListener.Close()
+
+	proxyClientConnCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := clientListener.Accept()
+		assert.NoError(t, err)
+		proxyClientConnCh <- conn
+	}()
+
+	backendConnCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backendListener.Accept()
+		assert.NoError(t, err)
+		backendConnCh <- conn
+	}()
+
+	testClientConn, err := net.Dial("tcp", clientListener.Addr().String())
+	assert.NoError(t, err)
+	defer testClientConn.Close()
+
+	serverConn, err := net.Dial("tcp", backendListener.Addr().String())
+	assert.NoError(t, err)
+
+	proxyClientConn := <-proxyClientConnCh
+	backendConn := <-backendConnCh
+	defer backendConn.Close()
+
+	reader := bufio.NewReader(proxyClientConn)
+	wrappedClient := &bufConn{Conn: proxyClientConn, reader: reader}
+
+	done := make(chan struct{})
+	go func() {
+		proxyConn(context.Background(), wrappedClient, serverConn, proxyConnOptions{
+			IdleTimeout: 5 * time.Second,
+			Hostname:    "example.com",
+			Backend:     "backend",
+		})
+		close(done)
+	}()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	_, err = testClientConn.Write(request)
+	assert.NoError(t, err)
+	assert.NoError(t, testClientConn.(*net.TCPConn).CloseWrite())
+
+	gotRequest := make([]byte, len(request))
+	_, err = io.ReadFull(backendConn, gotRequest)
+	assert.NoError(t, err)
+	assert.Equal(t, request, gotRequest)
+
+	const responseSize = 8 * 1024 * 1024
+	response := make([]byte, responseSize)
+	for i := range response {
+		response[i] = byte(i)
+	}
+
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := backendConn.Write(response)
+		if err == nil {
+			err = backendConn.(*net.TCPConn).CloseWrite()
+		}
+		writeErrCh <- err
+	}()
+
+	received := make([]byte, responseSize)
+	_, err = io.ReadFull(testClientConn, received)
+	assert.NoError(t, err, "client should receive the full response despite having half-closed its write side")
+	assert.Equal(t, response, received)
+
+	assert.NoError(t, <-writeErrCh)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxyConn did not finish after both halves drained")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteProxyProtocolV2TCP4RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}
+	tlvs := []proxyProtocolV2TLV{{Type: pp2TypeAuthority, Value: []byte("example.com")}}
+
+	assert.NoError(t, writeProxyProtocolV2(&fakeConn{Writer: &buf}, src, dst, tlvs))
+
+	reader := bufio.NewReader(&buf)
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	assert.NoError(t, err)
+	assert.Equal(t, proxyProtocolV2Signature, string(signature))
+
+	decoded, err := readProxyProtocolV2(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, src.IP.String(), decoded.IP.String())
+	assert.Equal(t, src.Port, decoded.Port)
+}
+
+func TestWriteProxyProtocolV2TCP6RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	src := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 443}
+
+	assert.NoError(t, writeProxyProtocolV2(&fakeConn{Writer: &buf}, src, dst, nil))
+
+	reader := bufio.NewReader(&buf)
+	decoded, err := readProxyProtocolV2(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, src.IP.String(), decoded.IP.String())
+	assert.Equal(t, src.Port, decoded.Port)
+}
+
+func TestWriteProxyProtocolV2FallsBackToLocalForNonTCPAddr(t *testing.T) {
+	var buf bytes.Buffer
+	src := &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}
+
+	assert.NoError(t, writeProxyProtocolV2(&fakeConn{Writer: &buf}, src, dst, nil))
+
+	reader := bufio.NewReader(&buf)
+	decoded, err := readProxyProtocolV2(reader)
+	assert.NoError(t, err)
+	assert.True(t, decoded == nil, "LOCAL command should decode to a nil address")
+}
+
+func TestReadProxyProtocolV1(t *testing.T) {
+	cases := []struct {
+		name     string
+		line     string
+		wantIP   string
+		wantPort int
+		wantNil  bool
+		wantErr  bool
+	}{
+		{name: "tcp4", line: "PROXY TCP4 192.168.0.1 192.168.0.2 56324 443\r\n", wantIP: "192.168.0.1", wantPort: 56324},
+		{name: "tcp6", line: "PROXY TCP6 fe80::1 fe80::2 56324 443\r\n", wantIP: "fe80::1", wantPort: 56324},
+		{name: "unknown", line: "PROXY UNKNOWN 0.0.0.0 0.0.0.0 0 0\r\n", wantNil: true},
+		{name: "malformed", line: "PROXY TCP4 not-an-ip 192.168.0.2 56324 443\r\n", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader([]byte(c.line)))
+			addr, err := readProxyProtocolV1(reader)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if c.wantNil {
+				assert.True(t, addr == nil)
+				return
+			}
+			assert.Equal(t, c.wantIP, addr.IP.String())
+			assert.Equal(t, c.wantPort, addr.Port)
+		})
+	}
+}
+
+func TestReadProxyProtocolHeaderDetectsVersion(t *testing.T) {
+	t.Run("v1", func(t *testing.T) {
+		conn, reader := newTestConnReader("PROXY TCP4 192.168.0.1 192.168.0.2 56324 443\r\nGET / HTTP/1.1\r\n\r\n")
+		addr, err := readProxyProtocolHeader(conn, reader, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "192.168.0.1", addr.IP.String())
+
+		rest, _ := reader.Peek(15)
+		assert.Equal(t, "GET / HTTP/1.1\r", string(rest))
+	})
+
+	t.Run("no header", func(t *testing.T) {
+		conn, reader := newTestConnReader("GET / HTTP/1.1\r\n\r\n")
+		addr, err := readProxyProtocolHeader(conn, reader, 0)
+		assert.NoError(t, err)
+		assert.True(t, addr == nil)
+
+		rest, _ := reader.Peek(15)
+		assert.Equal(t, "GET / HTTP/1.1\r", string(rest))
+	})
+}
+
+// fakeConn is a minimal net.Conn backed by an io.Writer, used to capture
+// writeProxyProtocolV2's output without needing a real socket.
+type fakeConn struct {
+	net.Conn
+	Writer interface {
+		Write([]byte) (int, error)
+	}
+}
+
+func (f *fakeConn) Write(b []byte) (int, error) { return f.Writer.Write(b) }
+
+func newTestConnReader(data string) (net.Conn, *bufio.Reader) {
+	server, client := net.Pipe()
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+	return server, bufio.NewReader(server)
+}
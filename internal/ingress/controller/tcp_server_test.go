@@ -0,0 +1,129 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPServerAcquireReleaseSlot(t *testing.T) {
+	s := &TCPServer{MaxConcurrentConnections: 2}
+
+	assert.True(t, s.acquireSlot())
+	assert.True(t, s.acquireSlot())
+	assert.False(t, s.acquireSlot(), "a third slot should be rejected at capacity")
+
+	s.releaseSlot()
+	assert.True(t, s.acquireSlot(), "releasing a slot should free capacity for a new connection")
+}
+
+func TestTCPServerAcquireSlotUnlimited(t *testing.T) {
+	s := &TCPServer{}
+	for i := 0; i < 100; i++ {
+		assert.True(t, s.acquireSlot())
+	}
+}
+
+func TestTCPServerCircuitBreaker(t *testing.T) {
+	s := &TCPServer{FailureThreshold: 2, CooldownPeriod: 50 * time.Millisecond}
+
+	assert.False(t, s.breakerOpen())
+
+	s.recordDialFailure()
+	assert.False(t, s.breakerOpen(), "breaker should stay closed below FailureThreshold")
+
+	s.recordDialFailure()
+	assert.True(t, s.breakerOpen(), "breaker should open once FailureThreshold consecutive failures are recorded")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, s.breakerOpen(), "breaker should close again once CooldownPeriod has elapsed")
+}
+
+func TestTCPServerCircuitBreakerResetsOnSuccess(t *testing.T) {
+	s := &TCPServer{FailureThreshold: 2, CooldownPeriod: time.Minute}
+
+	s.recordDialFailure()
+	s.recordDialSuccess()
+	s.recordDialFailure()
+	assert.False(t, s.breakerOpen(), "a success should reset the consecutive failure count")
+}
+
+func TestTCPServerCircuitBreakerDisabled(t *testing.T) {
+	s := &TCPServer{}
+	for i := 0; i < 10; i++ {
+		s.recordDialFailure()
+	}
+	assert.False(t, s.breakerOpen(), "FailureThreshold of zero disables the breaker")
+}
+
+func TestTCPProxyDrainWaitsForActiveConnections(t *testing.T) {
+	s := &TCPServer{}
+	client, _ := net.Pipe()
+	s.trackConn(client)
+
+	done := make(chan struct{})
+	p := &TCPProxy{}
+	go func() {
+		p.Drain(context.Background(), s)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Drain returned before the active connection was untracked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.True(t, s.isDraining())
+	s.untrackConn(client)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return after the active connection finished")
+	}
+}
+
+func TestTCPProxyDrainForceClosesOnDeadline(t *testing.T) {
+	s := &TCPServer{}
+	client, _ := net.Pipe()
+	s.trackConn(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	p := &TCPProxy{}
+	go func() {
+		p.Drain(ctx, s)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return after its context deadline")
+	}
+
+	_, err := client.Write([]byte("x"))
+	assert.Error(t, err, "the connection should have been force-closed once the drain deadline passed")
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildClientHello assembles a minimal TLS 1.2 ClientHello record carrying
+// an SNI extension (when sni is non-empty) and an ALPN extension (when
+// alpns is non-empty), for exercising parseClientHello end to end.
+func buildClientHello(sni string, alpns []string) []byte {
+	var extensions []byte
+
+	if sni != "" {
+		name := []byte(sni)
+		serverNameEntry := append([]byte{0x00, byte(len(name) >> 8), byte(len(name))}, name...)
+		serverNameList := append([]byte{byte(len(serverNameEntry) >> 8), byte(len(serverNameEntry))}, serverNameEntry...)
+		extensions = append(extensions, 0x00, 0x00, byte(len(serverNameList)>>8), byte(len(serverNameList)))
+		extensions = append(extensions, serverNameList...)
+	}
+
+	if len(alpns) > 0 {
+		var protocolList []byte
+		for _, p := range alpns {
+			protocolList = append(protocolList, byte(len(p)))
+			protocolList = append(protocolList, []byte(p)...)
+		}
+		alpnExt := append([]byte{byte(len(protocolList) >> 8), byte(len(protocolList))}, protocolList...)
+		extensions = append(extensions, 0x00, 0x10, byte(len(alpnExt)>>8), byte(len(alpnExt)))
+		extensions = append(extensions, alpnExt...)
+	}
+
+	body := make([]byte, 0, 64)
+	body = append(body, 0x03, 0x03)             // client_version
+	body = append(body, make([]byte, 32)...)    // random
+	body = append(body, 0x00)                   // session_id (empty)
+	body = append(body, 0x00, 0x02, 0x00, 0x2f) // cipher_suites (one entry)
+	body = append(body, 0x01, 0x00)             // compression_methods (null only)
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))
+	body = append(body, extensions...)
+
+	handshake := append([]byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+
+	record := append([]byte{0x16, 0x03, 0x03, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+	return record
+}
+
+func TestParseClientHello(t *testing.T) {
+	t.Run("sni and alpn", func(t *testing.T) {
+		hostname, alpn, ok := parseClientHello(buildClientHello("example.com", []string{"h2", "http/1.1"}))
+		assert.True(t, ok)
+		assert.Equal(t, "example.com", hostname)
+		assert.Equal(t, []string{"h2", "http/1.1"}, alpn)
+	})
+
+	t.Run("sni only", func(t *testing.T) {
+		hostname, alpn, ok := parseClientHello(buildClientHello("foo.example.com", nil))
+		assert.True(t, ok)
+		assert.Equal(t, "foo.example.com", hostname)
+		assert.True(t, alpn == nil)
+	})
+
+	t.Run("not a handshake record", func(t *testing.T) {
+		_, _, ok := parseClientHello([]byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00})
+		assert.False(t, ok)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		hello := buildClientHello("example.com", []string{"h2"})
+		_, _, ok := parseClientHello(hello[:len(hello)-5])
+		assert.False(t, ok)
+	})
+
+	t.Run("no sni or alpn extensions", func(t *testing.T) {
+		_, _, ok := parseClientHello(buildClientHello("", nil))
+		assert.False(t, ok)
+	})
+}
+
+func TestParseSNIExtension(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "host name", data: []byte{0x00, 0x05, 0x00, 0x00, 0x02, 'h', 'i'}, want: "hi"},
+		{name: "too short", data: []byte{0x00}, want: ""},
+		{name: "non host_name type", data: []byte{0x00, 0x03, 0x01, 0x00, 0x01}, want: ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, parseSNIExtension(c.data))
+		})
+	}
+}
+
+func TestParseALPNExtension(t *testing.T) {
+	data := []byte{0x00, 0x06, 0x02, 'h', '2', 0x02, 'h', '3'}
+	assert.Equal(t, []string{"h2", "h3"}, parseALPNExtension(data))
+
+	assert.True(t, parseALPNExtension([]byte{0x00}) == nil)
+}
+
+func TestTCPProxyGetPrecedence(t *testing.T) {
+	exact := &TCPServer{Hostname: "exact.example.com"}
+	wildcardShort := &TCPServer{Hostname: "*.example.com"}
+	wildcardLong := &TCPServer{Hostname: "*.sub.example.com"}
+	regex := &TCPServer{Hostname: "~^regex-\\d+\\.other\\.net$"}
+	h2Only := &TCPServer{Hostname: "exact.example.com", Protocols: []string{"http/2"}}
+	alpnOnly := &TCPServer{Hostname: "alpn.other.net", ALPN: []string{"h2"}}
+	defaultServer := &TCPServer{Hostname: "default"}
+
+	proxy := &TCPProxy{
+		ServerList: []*TCPServer{exact, wildcardShort, wildcardLong, regex, h2Only, alpnOnly},
+		Default:    defaultServer,
+	}
+
+	t.Run("exact beats wildcard", func(t *testing.T) {
+		assert.Equal(t, exact, proxy.Get("tls", "exact.example.com", ""))
+	})
+
+	t.Run("longest matching wildcard wins", func(t *testing.T) {
+		assert.Equal(t, wildcardLong, proxy.Get("tls", "foo.sub.example.com", ""))
+		assert.Equal(t, wildcardShort, proxy.Get("tls", "foo.example.com", ""))
+	})
+
+	t.Run("wildcard does not match bare suffix", func(t *testing.T) {
+		assert.Equal(t, defaultServer, proxy.Get("tls", "example.com", ""))
+	})
+
+	t.Run("regex used when nothing else matches", func(t *testing.T) {
+		assert.Equal(t, regex, proxy.Get("tls", "regex-42.other.net", ""))
+	})
+
+	t.Run("falls back to default", func(t *testing.T) {
+		assert.Equal(t, defaultServer, proxy.Get("tls", "unknown.other.net", ""))
+	})
+
+	t.Run("protocol filter excludes non matching entries", func(t *testing.T) {
+		assert.Equal(t, defaultServer, proxy.Get("ssh", "exact.example.com", ""))
+		assert.Equal(t, h2Only, proxy.Get("http/2", "exact.example.com", ""))
+	})
+
+	t.Run("ALPN filter excludes non matching entries", func(t *testing.T) {
+		assert.Equal(t, defaultServer, proxy.Get("tls", "alpn.other.net", "http/1.1"))
+		assert.Equal(t, alpnOnly, proxy.Get("tls", "alpn.other.net", "h2"))
+	})
+
+	t.Run("nil server list returns default", func(t *testing.T) {
+		empty := &TCPProxy{Default: defaultServer}
+		assert.Equal(t, defaultServer, empty.Get("tls", "anything", ""))
+	})
+}
+
+func TestHTTP1SnifferStripsHostPort(t *testing.T) {
+	cases := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{name: "host with port", request: "GET / HTTP/1.1\r\nHost: example.com:9443\r\n\r\n", want: "example.com"},
+		{name: "host without port", request: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", want: "example.com"},
+		{name: "ipv6 literal with port", request: "GET / HTTP/1.1\r\nHost: [::1]:9443\r\n\r\n", want: "::1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			protocol, hostname, ok := http1Sniffer{}.Sniff([]byte(c.request))
+			assert.True(t, ok)
+			assert.Equal(t, "http/1.1", protocol)
+			assert.Equal(t, c.want, hostname)
+		})
+	}
+}
+
+func TestHTTP2ClearTextSnifferNeverMatches(t *testing.T) {
+	_, _, ok := sniffWithDefaultSniffers([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n" + "\x00\x00\x00\x01\x04\x00\x00\x00\x01"))
+	assert.False(t, ok, "no sniffer should claim to have routed a cleartext HTTP/2 connection by hostname")
+}
+
+// sniffWithDefaultSniffers runs peek through the same sniffers Handle uses
+// by default and reports the first one to reach a decision, if any.
+func sniffWithDefaultSniffers(peek []byte) (protocol, hostname string, ok bool) {
+	for _, sniffer := range defaultSniffers {
+		if proto, host, matched := sniffer.Sniff(peek); matched {
+			return proto, host, true
+		}
+	}
+	return "", "", false
+}